@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"go/ast"
+	"slices"
+	"strings"
+)
+
+// Codec contains the generated statements that encode, decode, and remap the entity references of a
+// component. The statements operate on a variable c that points to the component.
+type Codec struct {
+	Encode string
+	Decode string
+	Remap  string
+}
+
+var (
+	intTypes   = []string{"int", "int8", "int16", "int32", "int64", "rune"}
+	uintTypes  = []string{"uint", "uint8", "uint16", "uint32", "uint64", "uintptr", "byte"}
+	floatTypes = []string{"float32", "float64"}
+)
+
+type codecGen struct {
+	components []Component
+	compMap    map[string]int
+	encode     strings.Builder
+	decode     strings.Builder
+	remap      strings.Builder
+}
+
+// newCodec generates reflection free encoders and decoders for a component. Types that the generator
+// doesn't understand, like maps, pointers and types from other packages, fall back to encoding/gob.
+// Unexported struct fields can't be accessed by the generated package, so they are skipped.
+func newCodec(comp Component, components []Component, compMap map[string]int) Codec {
+	g := &codecGen{components: components, compMap: compMap}
+
+	root := "(*c)"
+	if _, ok := comp.typeExpr.(*ast.StructType); ok {
+		root = "c"
+	}
+	g.gen(comp.typeExpr, root, 0)
+
+	return Codec{
+		Encode: g.encode.String(),
+		Decode: g.decode.String(),
+		Remap:  g.remap.String(),
+	}
+}
+
+func (g *codecGen) gen(t ast.Expr, x string, depth int) {
+	switch t := t.(type) {
+	case *ast.ParenExpr:
+		g.gen(t.X, x, depth)
+	case *ast.Ident:
+		switch {
+		case slices.Contains(intTypes, t.Name):
+			g.line(&g.encode, "writeInt(sw, %s)", x)
+			g.line(&g.decode, "readInt(sr, &%s)", x)
+		case slices.Contains(uintTypes, t.Name):
+			g.line(&g.encode, "writeUint(sw, %s)", x)
+			g.line(&g.decode, "readUint(sr, &%s)", x)
+		case slices.Contains(floatTypes, t.Name):
+			g.line(&g.encode, "writeFloat(sw, %s)", x)
+			g.line(&g.decode, "readFloat(sr, &%s)", x)
+		case t.Name == "string":
+			g.line(&g.encode, "writeString(sw, %s)", x)
+			g.line(&g.decode, "readString(sr, &%s)", x)
+		case t.Name == "bool":
+			g.line(&g.encode, "writeBool(sw, %s)", x)
+			g.line(&g.decode, "readBool(sr, &%s)", x)
+		default:
+			if _, ok := g.compMap[t.Name]; !ok {
+				g.gob(x)
+				return
+			}
+			g.line(&g.encode, "encode%s(sw, &%s)", t.Name, x)
+			g.line(&g.decode, "decode%s(sr, &%s)", t.Name, x)
+			if g.hasRefs(t, map[string]bool{}) {
+				g.line(&g.remap, "remap%s(&%s, remap)", t.Name, x)
+			}
+		}
+	case *ast.SelectorExpr:
+		if !isRef(t) {
+			g.gob(x)
+			return
+		}
+		g.line(&g.encode, "writeUint(sw, %s)", x)
+		g.line(&g.decode, "readUint(sr, &%s)", x)
+		g.line(&g.remap, "%s = remap(%s)", x, x)
+	case *ast.ArrayType:
+		i := fmt.Sprintf("i%d", depth)
+		if t.Len == nil {
+			g.line(&g.encode, "sw.length(len(%s))", x)
+			// Slice elements are appended as they are decoded, so a corrupt length can't allocate more than the input holds
+			g.line(&g.decode, "for %s, n%d := 0, readSlice(sr, &%s); %s < n%d && sr.err == nil; %s++ {", i, depth, x, i, depth, i)
+			g.line(&g.decode, "growSlice(&%s)", x)
+		} else {
+			g.line(&g.decode, "for %s := range %s {", i, x)
+		}
+		g.line(&g.encode, "for %s := range %s {", i, x)
+		refs := g.hasRefs(t.Elt, map[string]bool{})
+		if refs {
+			g.line(&g.remap, "for %s := range %s {", i, x)
+		}
+		elem := &codecGen{components: g.components, compMap: g.compMap}
+		elem.gen(t.Elt, fmt.Sprintf("%s[%s]", x, i), depth+1)
+		g.encode.WriteString(elem.encode.String())
+		g.decode.WriteString(elem.decode.String())
+		g.remap.WriteString(elem.remap.String())
+		g.line(&g.encode, "}")
+		g.line(&g.decode, "}")
+		if refs {
+			g.line(&g.remap, "}")
+		}
+	case *ast.StructType:
+		for _, field := range t.Fields.List {
+			for _, name := range fieldNames(field) {
+				if !ast.IsExported(name) {
+					continue
+				}
+				g.gen(field.Type, x+"."+name, depth)
+			}
+		}
+	default:
+		g.gob(x)
+	}
+}
+
+func (g *codecGen) gob(x string) {
+	g.line(&g.encode, "writeGob(sw, &%s)", x)
+	g.line(&g.decode, "readGob(sr, &%s)", x)
+}
+
+func (g *codecGen) line(b *strings.Builder, format string, args ...any) {
+	b.WriteString("    ")
+	b.WriteString(fmt.Sprintf(format, args...))
+	b.WriteString("\n")
+}
+
+// hasRefs returns true if values of the type contain entity references that the generated code can remap.
+func (g *codecGen) hasRefs(t ast.Expr, visited map[string]bool) bool {
+	switch t := t.(type) {
+	case *ast.ParenExpr:
+		return g.hasRefs(t.X, visited)
+	case *ast.Ident:
+		index, ok := g.compMap[t.Name]
+		if !ok || visited[t.Name] {
+			return false
+		}
+		visited[t.Name] = true
+		return g.hasRefs(g.components[index].typeExpr, visited)
+	case *ast.SelectorExpr:
+		return isRef(t)
+	case *ast.ArrayType:
+		return g.hasRefs(t.Elt, visited)
+	case *ast.StructType:
+		for _, field := range t.Fields.List {
+			for _, name := range fieldNames(field) {
+				if ast.IsExported(name) && g.hasRefs(field.Type, visited) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func isRef(t *ast.SelectorExpr) bool {
+	pkg, ok := t.X.(*ast.Ident)
+	return ok && pkg.Name == "entity" && t.Sel.Name == "Ref"
+}
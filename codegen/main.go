@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"embed"
+	"flag"
 	"fmt"
 	"go/ast"
 	"go/parser"
@@ -14,6 +15,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"reflect"
 	"slices"
 	"strconv"
 	"strings"
@@ -33,6 +35,11 @@ var templFuncs = map[string]interface{}{
 	"compsubindex": func(index int) int {
 		return 1 << (index % 64)
 	},
+	"reverseargs": func(args []SelectArg) []SelectArg {
+		reversed := slices.Clone(args)
+		slices.Reverse(reversed)
+		return reversed
+	},
 	"makerange": func(i int) []int {
 		return make([]int, i)
 	},
@@ -48,6 +55,46 @@ var templFuncs = map[string]interface{}{
 		}
 		return "comp."
 	},
+	// argvalue returns the expression passed to a selector function for a non-relationship argument
+	"argvalue": func(a SelectArg, entity string) string {
+		switch {
+		case a.Without:
+			return "Without[comp." + a.Name + "]{}"
+		case a.Optional:
+			return "opt" + a.Name + "(" + entity + ")"
+		case a.Added:
+			return "Added[comp." + a.Name + "]{}"
+		case a.Changed:
+			return "Changed[comp." + a.Name + "]{}"
+		case a.With:
+			return "With[comp." + a.Name + "]{}"
+		}
+		return storePtr(a.Comp, "w", entity+".id()")
+	},
+	"storeptr": storePtr,
+	"tick":     tickRef,
+}
+
+// storePtr returns an expression that points at the storage of a component for the entity ID of a world. The
+// component must be set for the entity.
+func storePtr(c Component, world string, id string) string {
+	if c.Tag {
+		return fmt.Sprintf("&comp.%s{}", c.Name)
+	}
+	if c.Sparse {
+		return fmt.Sprintf("%s.sparsePtr%s(%s)", world, c.Name, id)
+	}
+	return fmt.Sprintf("&%s.store%s[%s >> entityPageBits][%s %% entityPageSize]", world, c.Name, id, id)
+}
+
+// tickRef returns an expression that refers to the added or changed tick of a component for the entity ID of a
+// world. The component must be set for the entity if it is sparse.
+func tickRef(c Component, kind string, world string, id string) string {
+	if c.Sparse {
+		return fmt.Sprintf("%s.dense%s%s[%s.sparse%s[%s >> entityPageBits][%s %% entityPageSize] - 1]",
+			world, strings.ToUpper(kind[:1])+kind[1:], c.Name, world, c.Name, id, id)
+	}
+	return fmt.Sprintf("%s.%s%s[%s >> entityPageBits][%s %% entityPageSize]", world, kind, c.Name, id, id)
 }
 
 type Ctx struct {
@@ -61,22 +108,81 @@ type Ctx struct {
 	SelectCount        int
 	Relationships      []Relationship
 	RelCount           int
+	Hierarchy          *Relationship
+	Archetype          bool
 }
 
 type structMember struct {
 	Name string
 	Type string
+	Tag  reflect.StructTag
 }
 
 type Relationship struct {
-	Name    string
-	HasData bool
+	Name      string
+	CompIndex int
+	HasData   bool
+	Reverse   bool
+	Exclusive bool
+	Symmetric bool
+	Hierarchy bool
+	OnKill    KillPolicy
+
+	// Weight is the name of the numeric data field that weighs the relationship in path searches.
+	Weight string
+}
+
+// KillPolicy determines what happens to the sources of a relationship when its target is killed.
+type KillPolicy int
+
+const (
+	// KillKeep leaves relationships to dead targets in place until they are pruned by Each.
+	KillKeep KillPolicy = iota
+	// KillRemove removes relationships to a target when it is killed.
+	KillRemove
+	// KillCascade kills the sources of a relationship when its target is killed.
+	KillCascade
+)
+
+// relationshipMarkers are the empty struct fields that may follow the Relationship marker of a relationship
+// component to opt in to additional behavior. They aren't treated as relationship data.
+var relationshipMarkers = []string{"Reverse", "Exclusive", "Symmetric", "Hierarchy", "OnTargetKillRemove", "OnTargetKillCascade", "Sparse"}
+
+// SharedData returns true if both ends of a symmetric relationship point at the same relationship data.
+func (r Relationship) SharedData() bool {
+	return r.Symmetric && r.HasData
+}
+
+// Cascade returns true if sources of the relationship are killed along with their target.
+func (r Relationship) Cascade() bool {
+	return r.OnKill == KillCascade
+}
+
+// Unlink returns true if relationships are removed from their sources when the target is killed.
+func (r Relationship) Unlink() bool {
+	return r.OnKill == KillRemove
 }
 
 type Component struct {
 	Name          string
 	StructMembers []structMember
 	Relationship  bool
+	Codec         Codec
+	// Sparse components are stored in a sparse set rather than a page of every entity
+	Sparse bool
+	// Tag components are empty structs, which don't need any storage
+	Tag bool
+	// Change ticks are only recorded for components that are used with Added, Changed or Mark$NameChanged,
+	// and removals for components that are used with Removed$Name
+	TrackChanges  bool
+	TrackRemovals bool
+
+	typeExpr ast.Expr
+}
+
+// HasData returns true if the component is a relationship that carries data.
+func (c Component) HasData() bool {
+	return c.Relationship && len(c.StructMembers) > 1
 }
 
 type SelectArg struct {
@@ -84,21 +190,221 @@ type SelectArg struct {
 	CompIndex    int
 	Comp         Component
 	Relationship bool
+	Without      bool
+	Optional     bool
+	Added        bool
+	Changed      bool
+	With         bool
+
+	// Join is set for relationship arguments whose target must equal the target of the previous relationship
+	// argument. RelIndex is the position of a relationship argument among the relationships of the select, and
+	// JoinIndex is the RelIndex of the relationship that a joined argument shares its target with.
+	Join      bool
+	RelIndex  int
+	JoinIndex int
+}
+
+// Type returns the type of the selector function parameters that the argument matches.
+func (a SelectArg) Type() string {
+	switch {
+	case a.Without:
+		return "Without[comp." + a.Name + "]"
+	case a.Optional:
+		return "Opt[comp." + a.Name + "]"
+	case a.Added:
+		return "Added[comp." + a.Name + "]"
+	case a.Changed:
+		return "Changed[comp." + a.Name + "]"
+	case a.With:
+		return "With[comp." + a.Name + "]"
+	case a.Join:
+		return "Join, *comp." + a.Name
+	case a.Relationship:
+		return "Entity, *comp." + a.Name
+	}
+	return "*comp." + a.Name
 }
 
 type Select struct {
-	Args         []SelectArg
-	Relationship *Relationship
-	EarlyStop    bool
+	Args      []SelectArg
+	EarlyStop bool
+}
+
+// Name returns an identifier for the select that is derived from its arguments.
+func (s Select) Name() string {
+	if s.EarlyStop {
+		return s.BaseName() + "Stop"
+	}
+	return s.BaseName()
+}
+
+// BaseName returns an identifier for the arguments of the select.
+func (s Select) BaseName() string {
+	name := &strings.Builder{}
+	for _, arg := range s.Args {
+		switch {
+		case arg.Without:
+			name.WriteString("Without")
+		case arg.Optional:
+			name.WriteString("Opt")
+		case arg.Added:
+			name.WriteString("Added")
+		case arg.Changed:
+			name.WriteString("Changed")
+		case arg.With:
+			name.WriteString("With")
+		case arg.Join:
+			name.WriteString("Join")
+		}
+		name.WriteString(arg.Name)
+	}
+	return name.String()
+}
+
+// FuncType returns the type of the selector function that the select matches.
+func (s Select) FuncType() string {
+	funcType := &strings.Builder{}
+	funcType.WriteString("func(Entity")
+	for _, arg := range s.Args {
+		funcType.WriteString(", " + arg.Type())
+	}
+	funcType.WriteString(")")
+	if s.EarlyStop {
+		funcType.WriteString(" bool")
+	}
+	return funcType.String()
+}
+
+// Params returns the parameter list of a function literal that matches the select, with the parameters named
+// after their position. The target of a relationship argument is named t rather than a.
+func (s Select) Params() string {
+	params := &strings.Builder{}
+	params.WriteString("entity Entity")
+	for i, arg := range s.Args {
+		switch {
+		case arg.Join:
+			params.WriteString(fmt.Sprintf(", t%d Join, a%d *comp.%s", i, i, arg.Name))
+		case arg.Relationship:
+			params.WriteString(fmt.Sprintf(", t%d Entity, a%d *comp.%s", i, i, arg.Name))
+		default:
+			params.WriteString(fmt.Sprintf(", a%d %s", i, arg.Type()))
+		}
+	}
+	return params.String()
+}
+
+// ParamNames returns the names of the parameters returned by Params.
+func (s Select) ParamNames() string {
+	names := &strings.Builder{}
+	names.WriteString("entity")
+	for i, arg := range s.Args {
+		if arg.Relationship {
+			names.WriteString(fmt.Sprintf(", t%d", i))
+		}
+		names.WriteString(fmt.Sprintf(", a%d", i))
+	}
+	return names.String()
+}
+
+// RowField holds the names of the fields of an iterator row that hold an argument of the select. Target is
+// only set for relationships that aren't joined, and both are empty for arguments without a value.
+type RowField struct {
+	Name   string
+	Target string
+}
+
+// RowFields returns the row fields of each argument of the select. Fields are named after their component,
+// and numbered when the name is already taken, like when a component is selected twice.
+func (s Select) RowFields() []RowField {
+	taken := make(map[string]bool)
+	field := func(name string) string {
+		unique := name
+		for n := 2; taken[unique]; n++ {
+			unique = fmt.Sprintf("%s%d", name, n)
+		}
+		taken[unique] = true
+		return unique
+	}
+
+	fields := make([]RowField, len(s.Args))
+	for i, arg := range s.Args {
+		if arg.Without || arg.With || arg.Added || arg.Changed {
+			continue
+		}
+		if arg.Relationship && !arg.Join && !arg.Optional {
+			fields[i].Target = field(arg.Name + "Target")
+		}
+		fields[i].Name = field(arg.Name)
+	}
+	return fields
+}
+
+// Required returns the arguments of the select that an entity must have to be matched. Each component
+// is only returned once, even if it is used by multiple arguments.
+func (s Select) Required() []SelectArg {
+	var required []SelectArg
+	for _, arg := range s.Args {
+		if arg.Without || arg.Optional {
+			continue
+		}
+		if slices.ContainsFunc(required, func(r SelectArg) bool { return r.CompIndex == arg.CompIndex }) {
+			continue
+		}
+		required = append(required, arg)
+	}
+	return required
+}
+
+// Tracked returns the Added and Changed filter arguments of the select.
+func (s Select) Tracked() []SelectArg {
+	var tracked []SelectArg
+	for _, arg := range s.Args {
+		if arg.Added || arg.Changed {
+			tracked = append(tracked, arg)
+		}
+	}
+	return tracked
+}
+
+// TrackedRemovals returns true if any component records its removals.
+func (c *Ctx) TrackedRemovals() bool {
+	return slices.ContainsFunc(c.Comps, func(comp Component) bool { return comp.TrackRemovals })
+}
+
+// Rels returns the relationship arguments of the select, in the order that they are iterated.
+func (s Select) Rels() []SelectArg {
+	var rels []SelectArg
+	for _, arg := range s.Args {
+		if arg.Relationship {
+			rels = append(rels, arg)
+		}
+	}
+	return rels
+}
+
+// Excluded returns the arguments of the select that an entity must not have to be matched.
+func (s Select) Excluded() []SelectArg {
+	var excluded []SelectArg
+	for _, arg := range s.Args {
+		if arg.Without {
+			excluded = append(excluded, arg)
+		}
+	}
+	return excluded
 }
 
 func main() {
-	if len(os.Args) < 3 {
-		log.Fatal("usage: go generate ecs/codegen package_name component_pkg")
+	storage := flag.String("storage", "bitset", "layout used to store entities, bitset or archetype")
+	flag.Parse()
+	if flag.NArg() < 2 {
+		log.Fatal("usage: go generate ecs/codegen [-storage=bitset|archetype] package_name component_pkg")
+	}
+	if *storage != "bitset" && *storage != "archetype" {
+		log.Fatalf("unknown storage %q, expected bitset or archetype", *storage)
 	}
 
-	generatedPackage := os.Args[1]
-	componentPkg := os.Args[2]
+	generatedPackage := flag.Arg(0)
+	componentPkg := flag.Arg(1)
 
 	genFile, ok := os.LookupEnv("GOFILE")
 	if !ok {
@@ -130,7 +436,18 @@ func main() {
 	modulePath := ModulePath(modData)
 
 	comps, compMap, relationships := findComponents(componentPkg)
-	selects := findSelects(systemPkg, compMap, comps, relationships)
+	var hierarchy *Relationship
+	for i, rel := range relationships {
+		if !rel.Hierarchy {
+			continue
+		}
+		if hierarchy != nil {
+			log.Fatalf("relationships %s and %s are both hierarchies, only one is supported", hierarchy.Name, rel.Name)
+		}
+		hierarchy = &relationships[i]
+	}
+	selects := findSelects(systemPkg, compMap, comps)
+	findTracking(systemPkg, comps, selects)
 
 	context := &Ctx{
 		Pkg:                generatedPackage,
@@ -143,6 +460,8 @@ func main() {
 		SelectCount:        len(selects),
 		Relationships:      relationships,
 		RelCount:           len(relationships),
+		Hierarchy:          hierarchy,
+		Archetype:          *storage == "archetype",
 	}
 
 	err = setupPackage(context)
@@ -194,7 +513,80 @@ func ModulePath(mod []byte) string {
 	return "" // missing module path
 }
 
-func findSelects(path string, compNames map[string]int, components []Component, relationships []Relationship) []Select {
+// findTracking marks the components whose changes or removals are observed by the module, so that worlds
+// don't pay for change detection that is never used.
+func findTracking(path string, components []Component, selects []Select) {
+	fset := token.NewFileSet()
+	dir, err := parser.ParseDir(fset, path, nil, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, pkg := range dir {
+		for _, fi := range pkg.Files {
+			ast.Inspect(fi, func(n ast.Node) bool {
+				if ident, ok := n.(*ast.Ident); ok {
+					names[ident.Name] = true
+				}
+				return true
+			})
+		}
+	}
+
+	for i := range components {
+		if components[i].Relationship {
+			continue
+		}
+		components[i].TrackChanges = names["Mark"+components[i].Name+"Changed"]
+		components[i].TrackRemovals = names["Removed"+components[i].Name]
+	}
+	for _, sel := range selects {
+		for _, arg := range sel.Tracked() {
+			components[arg.CompIndex].TrackChanges = true
+		}
+	}
+}
+
+// checkTargetSelect stops code generation if a selector function that matches relationships is passed to a
+// Select$RelationshipTarget function, so that the unsupported selector is a build error rather than a panic.
+func checkTargetSelect(fset *token.FileSet, call *ast.CallExpr, compNames map[string]int, components []Component) {
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || len(call.Args) != 2 {
+		return
+	}
+	rel, ok := strings.CutPrefix(sel.Sel.Name, "Select")
+	if !ok {
+		return
+	}
+	rel, ok = strings.CutSuffix(rel, "Target")
+	if index, found := compNames[rel]; !ok || !found || !components[index].Relationship {
+		return
+	}
+	selector, ok := call.Args[1].(*ast.FuncLit)
+	if !ok {
+		return
+	}
+
+	for _, param := range selector.Type.Params.List {
+		ptr, ok := param.Type.(*ast.StarExpr)
+		if !ok {
+			continue
+		}
+		compT, ok := ptr.X.(*ast.SelectorExpr)
+		if !ok {
+			continue
+		}
+		if index, found := compNames[compT.Sel.Name]; found && components[index].Relationship {
+			var funcType bytes.Buffer
+			_ = printer.Fprint(&funcType, fset, selector.Type)
+			log.Fatalf("%s: %s doesn't support selector functions that match relationships: %s",
+				fset.Position(selector.Pos()), sel.Sel.Name, funcType.String())
+		}
+	}
+}
+
+func findSelects(path string, compNames map[string]int, components []Component) []Select {
 	fset := token.NewFileSet()
 	dir, err := parser.ParseDir(fset, path, nil, parser.ParseComments)
 	if err != nil {
@@ -202,26 +594,69 @@ func findSelects(path string, compNames map[string]int, components []Component,
 	}
 
 	selects := make(map[string]Select)
+	addSelect := func(args []SelectArg, earlyStop bool) {
+		newSel := Select{
+			Args:      args,
+			EarlyStop: earlyStop,
+		}
+		if len(newSel.Required()) == 0 {
+			return
+		}
+		relIndex := 0
+		for i := range args {
+			if !args[i].Relationship {
+				continue
+			}
+			if args[i].Join && relIndex == 0 {
+				// There's no previous relationship to join with
+				return
+			}
+			args[i].RelIndex = relIndex
+			if args[i].Join {
+				for j := i - 1; j >= 0; j-- {
+					if args[j].Relationship {
+						args[i].JoinIndex = args[j].JoinIndex
+						break
+					}
+				}
+			} else {
+				args[i].JoinIndex = relIndex
+			}
+			relIndex++
+		}
+		selects[newSel.Name()] = newSel
+	}
 
-	// Inject at least one select to avoid unuse import errors in the generated select package
-	for firstComponent, _ := range compNames {
-		index := compNames[firstComponent]
-		comp := components[index]
+	// Inject at least one select to avoid unuse import errors in the generated select package. The first
+	// component in declaration order is used, so that the generated API is the same on every run.
+	for index, comp := range components {
 		if comp.Relationship {
 			continue
 		}
-		selects[firstComponent+","] = Select{Args: []SelectArg{{
-			Name:         firstComponent,
+		addSelect([]SelectArg{{
+			Name:         comp.Name,
 			CompIndex:    index,
 			Comp:         comp,
 			Relationship: false,
-		}}}
+		}}, false)
 		break
 	}
 
 	for _, pkg := range dir {
 		for _, fi := range pkg.Files {
 			ast.Inspect(fi, func(n ast.Node) bool {
+				if call, ok := n.(*ast.CallExpr); ok {
+					checkTargetSelect(fset, call, compNames, components)
+				}
+
+				// Iterators are requested by name, like ecs.IterPosVel()
+				if sel, ok := n.(*ast.SelectorExpr); ok && strings.HasPrefix(sel.Sel.Name, "Iter") {
+					if args, ok := parseSelectName(strings.TrimPrefix(sel.Sel.Name, "Iter"), compNames, components); ok {
+						addSelect(args, true)
+					}
+					return true
+				}
+
 				funcType, ok := n.(*ast.FuncType)
 				if !ok {
 					return true
@@ -262,16 +697,25 @@ func findSelects(path string, compNames map[string]int, components []Component,
 
 				var args []SelectArg
 				foundRelationship := false
-				completedRelationship := ""
+				foundJoin := false
 				for _, param := range funcType.Params.List[1:] {
 					switch paramT := param.Type.(type) {
 					case *ast.Ident:
 						return true
 					case *ast.SelectorExpr:
-						if paramT.Sel.Name == "Entity" && completedRelationship == "" {
+						if foundRelationship {
+							return true
+						}
+						if paramT.Sel.Name == "Entity" {
 							foundRelationship = true
 							continue
 						}
+						// A Join in place of the target joins the relationship with the previous relationship
+						if paramT.Sel.Name == "Join" && slices.ContainsFunc(args, func(a SelectArg) bool { return a.Relationship }) {
+							foundRelationship = true
+							foundJoin = true
+							continue
+						}
 						return true
 					case *ast.StarExpr:
 						switch startT := paramT.X.(type) {
@@ -290,42 +734,62 @@ func findSelects(path string, compNames map[string]int, components []Component,
 								return true
 							}
 							args = append(args, SelectArg{
-								Name: startT.Sel.Name, CompIndex: compIdx, Comp: comp, Relationship: foundRelationship,
+								Name: startT.Sel.Name, CompIndex: compIdx, Comp: comp, Relationship: foundRelationship, Join: foundJoin,
 							})
-							if foundRelationship {
-								completedRelationship = startT.Sel.Name
-							}
 							foundRelationship = false
+							foundJoin = false
+						}
+					case *ast.IndexExpr:
+						// Filter parameters of the form ecs.Without[comp.Name] or ecs.Opt[comp.Name]
+						filterT, ok := paramT.X.(*ast.SelectorExpr)
+						if !ok || foundRelationship {
+							return true
+						}
+						compT, ok := paramT.Index.(*ast.SelectorExpr)
+						if !ok {
+							return true
+						}
+						compIdx, ok := compNames[compT.Sel.Name]
+						if !ok {
+							return true
+						}
+						switch filterT.Sel.Name {
+						case "Without":
+							args = append(args, SelectArg{
+								Name: compT.Sel.Name, CompIndex: compIdx, Comp: components[compIdx], Without: true,
+							})
+						case "Opt":
+							if components[compIdx].Relationship {
+								return true
+							}
+							args = append(args, SelectArg{
+								Name: compT.Sel.Name, CompIndex: compIdx, Comp: components[compIdx], Optional: true,
+							})
+						case "With":
+							if components[compIdx].Relationship {
+								return true
+							}
+							args = append(args, SelectArg{
+								Name: compT.Sel.Name, CompIndex: compIdx, Comp: components[compIdx], With: true,
+							})
+						case "Added", "Changed":
+							if components[compIdx].Relationship {
+								return true
+							}
+							args = append(args, SelectArg{
+								Name: compT.Sel.Name, CompIndex: compIdx, Comp: components[compIdx],
+								Added: filterT.Sel.Name == "Added", Changed: filterT.Sel.Name == "Changed",
+							})
+						default:
+							return true
 						}
 					}
 				}
-				if foundRelationship && completedRelationship != "" {
+				if foundRelationship {
 					return true
 				}
 
-				key := &strings.Builder{}
-				for _, arg := range args {
-					key.WriteString(arg.Name + ",")
-				}
-				if earlyReturn {
-					key.WriteString("early_return,")
-				}
-				if len(args) == 0 {
-					return true
-				}
-
-				newSel := Select{
-					Args:      args,
-					EarlyStop: earlyReturn,
-				}
-				if completedRelationship != "" {
-					relIndex := slices.IndexFunc(relationships, func(r Relationship) bool {
-						return r.Name == completedRelationship
-					})
-					newSel.Relationship = &relationships[relIndex]
-				}
-				selects[key.String()] = newSel
-
+				addSelect(args, earlyReturn)
 				return true
 			})
 		}
@@ -335,9 +799,51 @@ func findSelects(path string, compNames map[string]int, components []Component,
 	for _, val := range selects {
 		uniqueSelects = append(uniqueSelects, val)
 	}
+	// Keep the generated code stable between runs
+	slices.SortFunc(uniqueSelects, func(a, b Select) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
 	return uniqueSelects
 }
 
+// parseSelectName converts a select name, as returned by Select.Name, back into the arguments of the select.
+func parseSelectName(name string, compNames map[string]int, components []Component) ([]SelectArg, bool) {
+	if name == "" {
+		return nil, true
+	}
+
+	for _, prefix := range []string{"", "Without", "With", "Opt", "Added", "Changed", "Join"} {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		for _, comp := range components {
+			compName, compIdx := comp.Name, compNames[comp.Name]
+			if !strings.HasPrefix(rest, compName) {
+				continue
+			}
+			// Only plain and Without arguments can be relationships, and only relationships can be joined
+			if comp.Relationship && (prefix == "With" || prefix == "Opt" || prefix == "Added" || prefix == "Changed") {
+				continue
+			}
+			if !comp.Relationship && prefix == "Join" {
+				continue
+			}
+			args, ok := parseSelectName(strings.TrimPrefix(rest, compName), compNames, components)
+			if !ok {
+				continue
+			}
+			arg := SelectArg{
+				Name: compName, CompIndex: compIdx, Comp: components[compIdx],
+				Without: prefix == "Without", Optional: prefix == "Opt", Added: prefix == "Added", Changed: prefix == "Changed",
+				With: prefix == "With", Relationship: comp.Relationship && prefix != "Without", Join: prefix == "Join",
+			}
+			return append([]SelectArg{arg}, args...), true
+		}
+	}
+	return nil, false
+}
+
 func findComponents(path string) ([]Component, map[string]int, []Relationship) {
 	fset := token.NewFileSet()
 	dir, err := parser.ParseDir(fset, path, nil, parser.ParseComments)
@@ -361,17 +867,77 @@ func findComponents(path string) ([]Component, map[string]int, []Relationship) {
 					for _, field := range structType.Fields.List {
 						var typeString strings.Builder
 						_ = printer.Fprint(&typeString, fset, field.Type)
-						member := structMember{
-							Name: field.Names[0].Name,
-							Type: typeString.String(),
+						var tag reflect.StructTag
+						if field.Tag != nil {
+							tag = reflect.StructTag(strings.Trim(field.Tag.Value, "`"))
+						}
+						for _, name := range fieldNames(field) {
+							member := structMember{
+								Name: name,
+								Type: typeString.String(),
+								Tag:  tag,
+							}
+							structMembers = append(structMembers, member)
 						}
-						structMembers = append(structMembers, member)
 					}
 				}
 
-				comp := Component{Name: typeSpec.Name.Name, StructMembers: structMembers}
+				comp := Component{Name: typeSpec.Name.Name, StructMembers: structMembers, typeExpr: typeSpec.Type}
+				comp.Tag = ok && len(structType.Fields.List) == 0
+				comp.Sparse = slices.ContainsFunc(structMembers, func(member structMember) bool {
+					return member.Name == "Sparse" && member.Type == "struct{}"
+				})
 				if len(structMembers) > 0 && structMembers[0].Name == "Relationship" && structMembers[0].Type == "struct{}" {
-					relationships = append(relationships, Relationship{Name: typeSpec.Name.Name, HasData: len(structMembers) > 1})
+					rel := Relationship{Name: typeSpec.Name.Name, CompIndex: len(components)}
+					comp.StructMembers = slices.DeleteFunc(structMembers, func(member structMember) bool {
+						if member.Type != "struct{}" || !slices.Contains(relationshipMarkers, member.Name) {
+							return false
+						}
+						switch member.Name {
+						case "Reverse":
+							rel.Reverse = true
+						case "Exclusive":
+							rel.Exclusive = true
+						case "Symmetric":
+							rel.Symmetric = true
+						case "Hierarchy":
+							// Each entity has a single parent, and children are found through the reverse index
+							rel.Hierarchy = true
+							rel.Exclusive = true
+							rel.Reverse = true
+						case "OnTargetKillRemove", "OnTargetKillCascade":
+							if rel.OnKill != KillKeep {
+								log.Fatalf("relationship %s has more than one target kill policy", rel.Name)
+							}
+							rel.OnKill = KillRemove
+							if member.Name == "OnTargetKillCascade" {
+								rel.OnKill = KillCascade
+							}
+							// Kill policies are enforced by finding the sources of the target
+							rel.Reverse = true
+						}
+						return true
+					})
+					rel.HasData = len(comp.StructMembers) > 1
+					for _, member := range comp.StructMembers {
+						if member.Tag.Get("ecs") != "weight" {
+							continue
+						}
+						if !slices.Contains(intTypes, member.Type) && !slices.Contains(uintTypes, member.Type) && !slices.Contains(floatTypes, member.Type) {
+							log.Fatalf("weight %s of relationship %s must be numeric", member.Name, rel.Name)
+						}
+						rel.Weight = member.Name
+					}
+					if rel.Hierarchy {
+						if rel.HasData || rel.Symmetric {
+							log.Fatalf("hierarchy relationship %s can't have data or be symmetric", rel.Name)
+						}
+						// Children of a killed entity become roots, unless they are killed with it
+						if rel.OnKill == KillKeep {
+							rel.OnKill = KillRemove
+						}
+					}
+					relationships = append(relationships, rel)
 					comp.Relationship = true
 				}
 				components = append(components, comp)
@@ -384,9 +950,35 @@ func findComponents(path string) ([]Component, map[string]int, []Relationship) {
 	for i, component := range components {
 		compMap[component.Name] = i
 	}
+	for i := range components {
+		components[i].Codec = newCodec(components[i], components, compMap)
+	}
 	return components, compMap, relationships
 }
 
+// fieldNames returns the names declared by a struct field. Embedded fields are named after their type.
+func fieldNames(field *ast.Field) []string {
+	if len(field.Names) == 0 {
+		fieldType := field.Type
+		if star, ok := fieldType.(*ast.StarExpr); ok {
+			fieldType = star.X
+		}
+		switch t := fieldType.(type) {
+		case *ast.Ident:
+			return []string{t.Name}
+		case *ast.SelectorExpr:
+			return []string{t.Sel.Name}
+		}
+		return nil
+	}
+
+	var names []string
+	for _, name := range field.Names {
+		names = append(names, name.Name)
+	}
+	return names
+}
+
 func recursiveCopy(fs embed.FS, dir string, packageName string, context *Ctx) error {
 	err := os.Mkdir(packageName, 0744)
 	if err != nil {
@@ -28,10 +28,17 @@ type Vel struct {
 	Y float64
 }
 
+type Frozen bool
+
 type Complex struct {
 	Target entity.Ref
 }
 
+type Inventory struct {
+	Items  []entity.Ref
+	Counts map[string]int
+}
+
 func (p Position) Dist(p2 Position) float64 {
 	return math.Sqrt(math.Pow(float64(p.X-p2.X), 2) + math.Pow(float64(p.Y-p2.Y), 2))
 }
@@ -44,3 +51,55 @@ type Has struct {
 type Likes struct {
 	Relationship struct{}
 }
+
+type Owes struct {
+	Relationship struct{}
+	Reverse      struct{}
+	Amount       int
+}
+
+type BelongsTo struct {
+	Relationship        struct{}
+	OnTargetKillCascade struct{}
+}
+
+type Targeting struct {
+	Relationship       struct{}
+	OnTargetKillRemove struct{}
+}
+
+type EquippedBy struct {
+	Relationship struct{}
+	Exclusive    struct{}
+	Reverse      struct{}
+	Slot         int
+}
+
+type FriendsWith struct {
+	Relationship struct{}
+	Symmetric    struct{}
+	Since        int
+}
+
+type ChildOf struct {
+	Relationship struct{}
+	Hierarchy    struct{}
+}
+
+type Road struct {
+	Relationship struct{}
+	Length       float64 `ecs:"weight"`
+}
+
+type Watches struct {
+	Relationship struct{}
+	Sparse       struct{}
+	Since        int
+}
+
+type Portrait struct {
+	Sparse struct{}
+	Pixels [64]uint32
+}
+
+type Player struct{}
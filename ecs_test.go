@@ -1,7 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -374,6 +382,194 @@ func TestRelationshipRemoveAll(t *testing.T) {
 	}
 }
 
+func TestRelationshipSource(t *testing.T) {
+	ecs.Reset()
+
+	bank := ecs.NewEntity()
+	alice := ecs.NewEntity()
+	bob := ecs.NewEntity()
+	carol := ecs.NewEntity()
+
+	alice.SetOwes(bank, components.Owes{Amount: 10})
+	bob.SetOwes(bank, components.Owes{Amount: 20})
+	carol.SetOwes(bank, components.Owes{Amount: 30})
+	carol.SetOwes(alice, components.Owes{Amount: 5})
+
+	total := 0
+	bank.EachOwesSource(func(src ecs.Entity, owes *components.Owes) {
+		total += owes.Amount
+	})
+	if total != 60 {
+		t.Fatal(total)
+	}
+
+	bob.Kill()
+	alice.RemoveOwes(bank)
+	total = 0
+	bank.EachOwesSource(func(src ecs.Entity, owes *components.Owes) {
+		if !src.Is(carol) {
+			t.Fatal(src)
+		}
+		total += owes.Amount
+	})
+	if total != 30 {
+		t.Fatal(total)
+	}
+
+	carol.RemoveAllOwes()
+	count := 0
+	bank.EachOwesSource(func(src ecs.Entity, owes *components.Owes) {
+		count++
+	})
+	alice.EachOwesSource(func(src ecs.Entity, owes *components.Owes) {
+		count++
+	})
+	if count != 0 {
+		t.Fatal(count)
+	}
+
+	// Relationships to a dead entity shouldn't be visible to a new entity with the same ID
+	alice.SetOwes(bank, components.Owes{Amount: 10})
+	bank.Kill()
+	newBank := ecs.NewEntity()
+	if alice.Owes(newBank) != nil {
+		t.Fatal()
+	}
+	newBank.EachOwesSource(func(src ecs.Entity, owes *components.Owes) {
+		t.Fatal(src)
+	})
+	if !alice.SetOwes(newBank, components.Owes{Amount: 15}) {
+		t.Fatal()
+	}
+	if alice.Owes(newBank).Amount != 15 {
+		t.Fatal()
+	}
+}
+
+func TestRelationshipKillPolicy(t *testing.T) {
+	ecs.Reset()
+
+	ship := ecs.NewEntity()
+	crew := ecs.NewEntity()
+	cargo := ecs.NewEntity()
+	crate := ecs.NewEntity()
+	turret := ecs.NewEntity()
+
+	crew.SetBelongsTo(ship)
+	cargo.SetBelongsTo(ship)
+	crate.SetBelongsTo(cargo)
+	turret.SetTargeting(ship)
+	turret.SetTargeting(crate)
+	turret.SetTargeting(crew)
+
+	crate.Kill()
+	if !cargo.Alive() || !ship.Alive() {
+		t.Fatal()
+	}
+
+	count := 0
+	turret.EachTargeting(func(target ecs.Entity) {
+		count++
+	})
+	if count != 2 {
+		t.Fatal(count)
+	}
+
+	ship.Kill()
+	if crew.Alive() || cargo.Alive() {
+		t.Fatal()
+	}
+	if turret.AnyTargeting() {
+		t.Fatal()
+	}
+
+	// Cascading kills terminate when relationships form a cycle
+	a := ecs.NewEntity()
+	b := ecs.NewEntity()
+	a.SetBelongsTo(b)
+	b.SetBelongsTo(a)
+	a.Kill()
+	if a.Alive() || b.Alive() {
+		t.Fatal()
+	}
+}
+
+func TestExclusiveRelationship(t *testing.T) {
+	ecs.Reset()
+
+	sword := ecs.NewEntity()
+	knight := ecs.NewEntity()
+	squire := ecs.NewEntity()
+
+	if _, ok := sword.EquippedByTarget(); ok {
+		t.Fatal()
+	}
+
+	if !sword.SetEquippedBy(knight, components.EquippedBy{Slot: 1}) {
+		t.Fatal()
+	}
+	if sword.SetEquippedBy(knight, components.EquippedBy{Slot: 2}) {
+		t.Fatal()
+	}
+	if !sword.SetEquippedBy(squire, components.EquippedBy{Slot: 3}) {
+		t.Fatal()
+	}
+
+	owner, ok := sword.EquippedByTarget()
+	if !ok || !owner.Is(squire) {
+		t.Fatal(owner)
+	}
+	if sword.EquippedBy(knight) != nil || sword.EquippedBy(squire).Slot != 3 {
+		t.Fatal()
+	}
+
+	count := 0
+	knight.EachEquippedBySource(func(src ecs.Entity, data *components.EquippedBy) {
+		count++
+	})
+	squire.EachEquippedBySource(func(src ecs.Entity, data *components.EquippedBy) {
+		count++
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+
+	squire.Kill()
+	if _, ok := sword.EquippedByTarget(); ok {
+		t.Fatal()
+	}
+}
+
+func TestSymmetricRelationship(t *testing.T) {
+	ecs.Reset()
+
+	alice := ecs.NewEntity()
+	bob := ecs.NewEntity()
+	carol := ecs.NewEntity()
+
+	alice.SetFriendsWith(bob, components.FriendsWith{Since: 2010})
+	carol.SetFriendsWith(alice, components.FriendsWith{Since: 2015})
+
+	friends := bob.FriendsWith(alice)
+	if friends == nil || friends.Since != 2010 {
+		t.Fatal(friends)
+	}
+	friends.Since = 2011
+	if alice.FriendsWith(bob).Since != 2011 {
+		t.Fatal()
+	}
+
+	bob.RemoveFriendsWith(alice)
+	if alice.FriendsWith(bob) != nil || bob.AnyFriendsWith() {
+		t.Fatal()
+	}
+
+	alice.RemoveAllFriendsWith()
+	if carol.FriendsWith(alice) != nil || carol.AnyFriendsWith() {
+		t.Fatal()
+	}
+}
+
 func TestRelationshipDanglingRef(t *testing.T) {
 	ecs.Reset()
 
@@ -473,77 +669,1317 @@ func BenchmarkRelationshipIter(b *testing.B) {
 	}
 }
 
-func TestHasComponent(t *testing.T) {
+func TestMultiRelationshipSelect(t *testing.T) {
 	ecs.Reset()
 
+	e := ecs.NewEntity()
+	apple := ecs.NewEntity()
+	gun := ecs.NewEntity()
+	egg := ecs.NewEntity()
+
+	e.SetHas(apple, components.Has{Count: 5})
+	e.SetHas(gun, components.Has{Count: 1})
+	e.SetLikes(apple)
+	e.SetLikes(egg)
+
+	pairs := 0
+	ecs.Select(func(e ecs.Entity, item ecs.Entity, has *components.Has, liked ecs.Entity, likes *components.Likes) {
+		pairs++
+	})
+	if pairs != 4 {
+		t.Fatal(pairs)
+	}
+
+	count := 0
+	ecs.Select(func(e ecs.Entity, item ecs.Entity, has *components.Has, _ ecs.Join, likes *components.Likes) {
+		if !item.Is(apple) || has.Count != 5 {
+			t.Fatal(item, has)
+		}
+		count++
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+}
+
+func TestSelectRelationshipTarget(t *testing.T) {
+	ecs.Reset()
+
+	apple := ecs.NewEntity()
+	boy := ecs.NewEntity()
+	girl := ecs.NewEntity()
 	dog := ecs.NewEntity()
-	dog.SetHealth(45)
-	dog.SetPosition(components.Position{45, 120})
 
-	if dog.HasVelocity() {
-		t.Fatal("incorrect component")
+	boy.SetHealth(10)
+	girl.SetHealth(20)
+	dog.SetHealth(30)
+
+	boy.SetLikes(apple)
+	girl.SetLikes(apple)
+	girl.SetLikes(dog)
+	dog.SetLikes(girl)
+
+	total := 0
+	ecs.SelectLikesTarget(apple, func(e ecs.Entity, hp *components.Health) {
+		total += int(*hp)
+	})
+	if total != 30 {
+		t.Fatal(total)
 	}
-	if !dog.HasHealth() {
-		t.Fatal("missing component")
+
+	count := 0
+	ecs.SelectHasTarget(apple, func(e ecs.Entity) {
+		count++
+	})
+	if count != 0 {
+		t.Fatal(count)
 	}
-	if !dog.HasPosition() {
-		t.Fatal("missing component")
+
+	// Relationships with a reverse index only visit the sources of the target
+	boy.SetOwes(dog, components.Owes{Amount: 1})
+	girl.SetOwes(dog, components.Owes{Amount: 2})
+	apple.SetOwes(dog, components.Owes{Amount: 4})
+	girl.SetOwes(boy, components.Owes{Amount: 8})
+	var sources []ecs.Entity
+	ecs.SelectOwesTarget(dog, func(e ecs.Entity, hp *components.Health) {
+		sources = append(sources, e)
+	})
+	if len(sources) != 2 || !sources[0].Is(boy) || !sources[1].Is(girl) {
+		t.Fatal(sources)
+	}
+	boy.Kill()
+	count = 0
+	ecs.SelectOwesTarget(dog, func(e ecs.Entity) {
+		count++
+	})
+	if count != 2 {
+		t.Fatal(count)
 	}
 
-	found := false
-	ecs.Select(func(e ecs.Entity, health *components.Health) {
-		found = true
+	// Relationship selectors passed directly are rejected by the code generator, others cause a panic
+	var selector any = func(e ecs.Entity, target ecs.Entity, has *components.Has) {}
+	defer func() {
+		if err := recover(); err == nil || !strings.Contains(fmt.Sprint(err), "not supported by SelectLikesTarget") {
+			t.Fatal(err)
+		}
+	}()
+	ecs.SelectLikesTarget(apple, selector)
+}
+
+func TestHierarchy(t *testing.T) {
+	ecs.Reset()
+
+	// Create children before their parents so that entity ID order differs from hierarchy order
+	leaf := ecs.NewEntity()
+	arm := ecs.NewEntity()
+	leg := ecs.NewEntity()
+	body := ecs.NewEntity()
+
+	for i, e := range []ecs.Entity{leaf, arm, leg, body} {
+		e.SetHealth(components.Health(i))
+	}
+	arm.SetParent(body)
+	leg.SetParent(body)
+	leaf.SetParent(arm)
+
+	if body.SetParent(leaf) {
+		t.Fatal("cycle created")
+	}
+	// Cycles are rejected however the relationship is set
+	if body.SetChildOf(leaf) || body.SetChildOf(body) {
+		t.Fatal("cycle created")
+	}
+	ecs.DefaultWorld().Commands().SetChildOf(body, arm)
+	ecs.DefaultWorld().Commands().Flush()
+	if _, ok := body.Parent(); ok {
+		t.Fatal("cycle created")
+	}
+	imported := ecs.NewWorld()
+	err := imported.ImportJSON(strings.NewReader(`{"entities": [
+		{"ref": 1, "components": {"ChildOf": [{"target": 2}]}},
+		{"ref": 2, "components": {"ChildOf": [{"target": 1}]}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := 0
+	imported.Select(func(e ecs.Entity, parent ecs.Entity, _ *components.ChildOf) {
+		links++
 	})
-	if !found {
-		t.Fatal("didn't find in select")
+	if links != 1 {
+		t.Fatal(links)
+	}
+	if parent, ok := leaf.Parent(); !ok || !parent.Is(arm) {
+		t.Fatal(parent)
+	}
+	if children := body.Children(); len(children) != 2 || !children[0].Is(arm) || !children[1].Is(leg) {
+		t.Fatal(children)
 	}
 
-	dog.Kill()
+	var order []ecs.Entity
+	body.WalkDepthFirst(func(e ecs.Entity, depth int) bool {
+		order = append(order, e)
+		return true
+	})
+	if len(order) != 4 || !order[1].Is(arm) || !order[2].Is(leaf) || !order[3].Is(leg) {
+		t.Fatal(order)
+	}
 
-	newDog := ecs.NewEntity()
-	newDog.SetHealth(45)
+	order = nil
+	body.WalkBreadthFirst(func(e ecs.Entity, depth int) bool {
+		order = append(order, e)
+		return true
+	})
+	if len(order) != 4 || !order[1].Is(arm) || !order[2].Is(leg) || !order[3].Is(leaf) {
+		t.Fatal(order)
+	}
 
-	if dog.HasHealth() {
-		t.Fatal("dead entity shouldn't have component")
+	order = nil
+	ecs.SelectHierarchical(func(e ecs.Entity, hp *components.Health) {
+		order = append(order, e)
+	})
+	// Entities at the same depth are visited in order of entity ID
+	if len(order) != 4 || !order[0].Is(body) || !order[1].Is(arm) || !order[2].Is(leg) || !order[3].Is(leaf) {
+		t.Fatal(order)
 	}
-	if !newDog.HasHealth() {
-		t.Fatal("new entity should have component")
+
+	// Killing a parent leaves its children as roots
+	leg.SetParent(arm)
+	arm.Kill()
+	if _, ok := leg.Parent(); ok {
+		t.Fatal()
+	}
+	if len(body.Children()) != 0 {
+		t.Fatal(body.Children())
+	}
+
+	leg.SetParent(body)
+	leaf.SetParent(leg)
+	body.KillRecursive()
+	if body.Alive() || leg.Alive() || leaf.Alive() {
+		t.Fatal()
 	}
 }
 
-func TestSystem(t *testing.T) {
+func TestRelationshipGraph(t *testing.T) {
 	ecs.Reset()
 
-	e := ecs.NewEntity()
-	e.SetPos(components.Pos{55.0, 56.0})
+	a := ecs.NewEntity()
+	b := ecs.NewEntity()
+	c := ecs.NewEntity()
+	d := ecs.NewEntity()
+	island := ecs.NewEntity()
 
-	order := -100
-	selector := func(pos int) func(e ecs.Entity, _ *components.Pos) {
-		return func(e ecs.Entity, _ *components.Pos) {
-			fmt.Println(pos)
-			if pos <= order {
-				t.Fatalf("system out of order: got %d, expected greater than %d", pos, order)
-			}
-			order = pos
-		}
+	a.SetRoad(b, components.Road{Length: 1})
+	b.SetRoad(c, components.Road{Length: 1})
+	a.SetRoad(c, components.Road{Length: 5})
+	c.SetRoad(d, components.Road{Length: 2})
+
+	if reached := a.ReachableRoad(); len(reached) != 3 {
+		t.Fatal(reached)
+	}
+	if reached := island.ReachableRoad(); len(reached) != 0 {
+		t.Fatal(reached)
 	}
 
-	ecs.AddSystem(selector(1))
-	ecs.AddSystem(selector(2))
-	ecs.AddSystem(selector(3))
-	ecs.AddSystem(selector(4))
+	path, dist, ok := a.ShortestPathRoad(d)
+	if !ok || dist != 4 || len(path) != 4 || !path[0].Is(a) || !path[1].Is(b) || !path[3].Is(d) {
+		t.Fatal(path, dist)
+	}
+	if _, _, ok := d.ShortestPathRoad(a); ok {
+		t.Fatal()
+	}
 
-	ecs.AddSystem(selector(-5), ecs.WithPhase(-1))
-	ecs.AddSystem(selector(-4), ecs.WithPhase(-1), ecs.WithPriority(2))
+	if ecs.HasCycleRoad() {
+		t.Fatal()
+	}
+	d.SetRoad(a, components.Road{Length: 1})
+	if !ecs.HasCycleRoad() {
+		t.Fatal()
+	}
 
-	ecs.AddSystem(selector(-3), ecs.WithPriority(-1))
-	ecs.Update()
+	// Dead entities are skipped
+	b.Kill()
+	path, dist, ok = a.ShortestPathRoad(d)
+	if !ok || dist != 7 || len(path) != 3 {
+		t.Fatal(path, dist)
+	}
+	c.Kill()
+	if ecs.HasCycleRoad() {
+		t.Fatal()
+	}
+
+	// A symmetric relationship and its reverse don't form a cycle
+	a.SetFriendsWith(island, components.FriendsWith{})
+	if ecs.HasCycleFriendsWith() {
+		t.Fatal()
+	}
+	island.SetFriendsWith(d, components.FriendsWith{})
+	d.SetFriendsWith(a, components.FriendsWith{})
+	if !ecs.HasCycleFriendsWith() {
+		t.Fatal()
+	}
 }
 
-func test1(entity ecs.Entity, health *components.Health) {
+func TestRelationshipStopEarly(t *testing.T) {
+	ecs.Reset()
+
+	apple := ecs.NewEntity()
+	egg := ecs.NewEntity()
+	for i := 0; i < 3; i++ {
+		e := ecs.NewEntity()
+		e.SetHas(apple, components.Has{Count: 1})
+		e.SetHas(egg, components.Has{Count: 2})
+	}
+
+	count := 0
+	ecs.Select(func(e ecs.Entity, target ecs.Entity, has *components.Has) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
 
+	var targets []ecs.Entity
+	ecs.SelectSorted(func(a ecs.Entity, b ecs.Entity) int {
+		return int(b.ID()) - int(a.ID())
+	}, func(e ecs.Entity, target ecs.Entity, has *components.Has) bool {
+		targets = append(targets, target)
+		return len(targets) < 3
+	})
+	if len(targets) != 3 || !targets[0].Is(apple) || !targets[1].Is(egg) || !targets[2].Is(apple) {
+		t.Fatal(targets)
+	}
 }
 
-func test2(entity ecs.Entity, pos *components.Position) {
+func TestSparseComponent(t *testing.T) {
+	ecs.Reset()
 
+	var entities []ecs.Entity
+	for i := 0; i < 3000; i++ {
+		e := ecs.NewEntity()
+		e.SetHealth(components.Health(i))
+		if i%1000 == 0 {
+			e.SetPortrait(components.Portrait{Pixels: [64]uint32{uint32(i)}})
+		}
+		entities = append(entities, e)
+	}
+
+	first, second, third := entities[0], entities[1000], entities[2000]
+	first.SetPortrait(components.Portrait{Pixels: [64]uint32{7}})
+	if first.Portrait().Pixels[0] != 7 || second.Portrait().Pixels[0] != 1000 {
+		t.Fatal()
+	}
+
+	// Removing a component moves the last dense component into its place
+	first.RemovePortrait()
+	if first.HasPortrait() || first.Portrait() != nil {
+		t.Fatal()
+	}
+	if third.Portrait().Pixels[0] != 2000 {
+		t.Fatal(third.Portrait().Pixels[0])
+	}
+
+	second.Kill()
+	total := 0
+	ecs.Select(func(e ecs.Entity, hp *components.Health, portrait *components.Portrait) {
+		if uint32(*hp) != portrait.Pixels[0] {
+			t.Fatal(*hp, portrait.Pixels[0])
+		}
+		total++
+	})
+	if total != 1 {
+		t.Fatal(total)
+	}
+
+	ecs.Select(func(e ecs.Entity, hp *components.Health, portrait ecs.Opt[components.Portrait]) {
+		if portrait.Ok() != e.Is(third) {
+			t.Fatal(e)
+		}
+	})
+
+	ecs.Reset()
+	e := ecs.NewEntity()
+	if e.HasPortrait() {
+		t.Fatal()
+	}
+	e.DefaultPortrait(components.Portrait{}).Pixels[1] = 3
+	if e.Portrait().Pixels[1] != 3 {
+		t.Fatal()
+	}
+
+	// Change ticks of sparse components are stored alongside them, so pages without the component cost nothing
+	w := ecs.NewWorld()
+	portraitBytes := func() uintptr {
+		for _, usage := range w.MemoryStats().Components {
+			if usage.Name == "Portrait" {
+				return usage.Bytes
+			}
+		}
+		t.Fatal("missing Portrait memory usage")
+		return 0
+	}
+	for i := 0; i < 3000; i++ {
+		w.NewEntity()
+	}
+	if portraitBytes() != 0 {
+		t.Fatal(portraitBytes())
+	}
+	changed := 0
+	w.AddSystem(func(e ecs.Entity, portrait *components.Portrait, _ ecs.Changed[components.Portrait]) {
+		changed++
+	})
+	first, second = w.NewEntity(), w.NewEntity()
+	first.SetPortrait(components.Portrait{})
+	second.SetPortrait(components.Portrait{})
+	w.Update()
+	if changed != 2 {
+		t.Fatal(changed)
+	}
+
+	second.Portrait().Pixels[0] = 1
+	second.MarkPortraitChanged()
+	first.RemovePortrait()
+	changed = 0
+	w.Update()
+	if changed != 1 {
+		t.Fatal(changed)
+	}
+}
+
+func TestSparseRelationshipEach(t *testing.T) {
+	w := ecs.NewWorld()
+
+	target := w.NewEntity()
+	first, second := w.NewEntity(), w.NewEntity()
+	first.SetWatches(target, components.Watches{Since: 1})
+	second.SetWatches(target, components.Watches{Since: 2})
+
+	// Removing the relationship of another entity moves the iterated relationship within the dense array
+	second.EachWatches(func(e ecs.Entity, watches *components.Watches) {
+		first.RemoveAllWatches()
+		watches.Since = 3
+	})
+	if watches := second.Watches(target); watches == nil || watches.Since != 3 {
+		t.Fatal(watches)
+	}
+
+	// Adding relationships to other entities reallocates the dense array
+	second.EachWatches(func(e ecs.Entity, watches *components.Watches) {
+		for i := 0; i < 100; i++ {
+			w.NewEntity().SetWatches(target, components.Watches{})
+		}
+		watches.Since = 4
+	})
+	if watches := second.Watches(target); watches == nil || watches.Since != 4 {
+		t.Fatal(watches)
+	}
+}
+
+func TestTagComponent(t *testing.T) {
+	ecs.Reset()
+
+	player := ecs.NewEntity()
+	player.SetPlayer()
+	player.SetHealth(100)
+	npc := ecs.NewEntity()
+	npc.SetHealth(50)
+
+	if !player.HasPlayer() || npc.HasPlayer() || player.Player() == nil {
+		t.Fatal()
+	}
+
+	count := 0
+	ecs.Select(func(e ecs.Entity, hp *components.Health, _ ecs.With[components.Player]) {
+		if !e.Is(player) {
+			t.Fatal(e)
+		}
+		count++
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+
+	player.RemovePlayer()
+	ecs.DefaultWorld().Commands().SetPlayer(npc)
+	ecs.DefaultWorld().Commands().Flush()
+	count = 0
+	ecs.Select(func(e ecs.Entity, hp *components.Health, _ ecs.With[components.Player]) {
+		if !e.Is(npc) {
+			t.Fatal(e)
+		}
+		count++
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+
+	// Tags don't use any memory until they are added to an entity of a page
+	w := ecs.NewWorld()
+	tagBytes := func() uintptr {
+		for _, usage := range w.MemoryStats().Components {
+			if usage.Name == "Player" {
+				return usage.Bytes
+			}
+		}
+		t.Fatal("missing Player memory usage")
+		return 0
+	}
+	if tagBytes() != 0 {
+		t.Fatal(tagBytes())
+	}
+	w.NewEntity().SetPlayer()
+	added := 0
+	w.Select(func(e ecs.Entity, _ ecs.Added[components.Player]) {
+		added++
+	})
+	if added != 1 || tagBytes() != 2*1024*4 {
+		t.Fatal(added, tagBytes())
+	}
+}
+
+func TestHasComponent(t *testing.T) {
+	ecs.Reset()
+
+	dog := ecs.NewEntity()
+	dog.SetHealth(45)
+	dog.SetPosition(components.Position{45, 120})
+
+	if dog.HasVelocity() {
+		t.Fatal("incorrect component")
+	}
+	if !dog.HasHealth() {
+		t.Fatal("missing component")
+	}
+	if !dog.HasPosition() {
+		t.Fatal("missing component")
+	}
+
+	found := false
+	ecs.Select(func(e ecs.Entity, health *components.Health) {
+		found = true
+	})
+	if !found {
+		t.Fatal("didn't find in select")
+	}
+
+	dog.Kill()
+
+	newDog := ecs.NewEntity()
+	newDog.SetHealth(45)
+
+	if dog.HasHealth() {
+		t.Fatal("dead entity shouldn't have component")
+	}
+	if !newDog.HasHealth() {
+		t.Fatal("new entity should have component")
+	}
+}
+
+func TestSystem(t *testing.T) {
+	ecs.Reset()
+
+	e := ecs.NewEntity()
+	e.SetPos(components.Pos{55.0, 56.0})
+
+	order := -100
+	selector := func(pos int) func(e ecs.Entity, _ *components.Pos) {
+		return func(e ecs.Entity, _ *components.Pos) {
+			fmt.Println(pos)
+			if pos <= order {
+				t.Fatalf("system out of order: got %d, expected greater than %d", pos, order)
+			}
+			order = pos
+		}
+	}
+
+	ecs.AddSystem(selector(1))
+	ecs.AddSystem(selector(2))
+	ecs.AddSystem(selector(3))
+	ecs.AddSystem(selector(4))
+
+	ecs.AddSystem(selector(-5), ecs.WithPhase(-1))
+	ecs.AddSystem(selector(-4), ecs.WithPhase(-1), ecs.WithPriority(2))
+
+	ecs.AddSystem(selector(-3), ecs.WithPriority(-1))
+	ecs.Update()
+}
+
+func TestWorlds(t *testing.T) {
+	t.Parallel()
+
+	server := ecs.NewWorld()
+	client := ecs.NewWorld()
+
+	serverDog := server.NewEntity()
+	serverDog.SetHealth(100)
+	clientDog := client.NewEntity()
+	clientDog.SetHealth(50)
+	client.NewEntity().SetHealth(25)
+
+	if serverDog.World() != server || clientDog.World() != client {
+		t.Fatal("entity has wrong world")
+	}
+	if serverDog.Is(clientDog) {
+		t.Fatal("entities from different worlds should differ")
+	}
+
+	total := 0
+	server.Select(func(e ecs.Entity, hp *components.Health) {
+		total += int(*hp)
+	})
+	if total != 100 {
+		t.Fatal(total)
+	}
+
+	total = 0
+	client.Select(func(e ecs.Entity, hp *components.Health) {
+		total += int(*hp)
+	})
+	if total != 75 {
+		t.Fatal(total)
+	}
+
+	server.Reset()
+	if serverDog.Alive() || !clientDog.Alive() {
+		t.Fatal("reset should only affect its own world")
+	}
+	if client.Lookup(clientDog.Ref()).Health() == nil {
+		t.Fatal("lookup failed")
+	}
+}
+
+func TestSelectWithout(t *testing.T) {
+	ecs.Reset()
+
+	moving := ecs.NewEntity()
+	moving.SetPosition(components.Position{X: 1})
+	moving.SetVelocity(components.Velocity{X: 1})
+
+	frozen := ecs.NewEntity()
+	frozen.SetPosition(components.Position{X: 1})
+	frozen.SetVelocity(components.Velocity{X: 1})
+	frozen.SetFrozen(true)
+
+	ecs.Select(func(e ecs.Entity, pos *components.Position, vel *components.Velocity, _ ecs.Without[components.Frozen]) {
+		pos.X += vel.X
+	})
+	if moving.Position().X != 2 || frozen.Position().X != 1 {
+		t.Fatal(moving.Position(), frozen.Position())
+	}
+
+	count := 0
+	ecs.Select(func(e ecs.Entity, _ ecs.Without[components.Frozen], pos *components.Position) bool {
+		count++
+		return true
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+}
+
+func TestSelectOptional(t *testing.T) {
+	ecs.Reset()
+
+	healthy := ecs.NewEntity()
+	healthy.SetPosition(components.Position{X: 1})
+	healthy.SetHealth(10)
+
+	fragile := ecs.NewEntity()
+	fragile.SetPosition(components.Position{X: 2})
+
+	total := 0
+	missing := 0
+	ecs.Select(func(e ecs.Entity, pos *components.Position, hp ecs.Opt[components.Health]) {
+		if !hp.Ok() {
+			missing++
+			return
+		}
+		*hp.Get() += 5
+		total += int(*hp.Get())
+	})
+	if total != 15 || missing != 1 || *healthy.Health() != 15 {
+		t.Fatal(total, missing)
+	}
+}
+
+func TestChangeDetection(t *testing.T) {
+	w := ecs.NewWorld()
+
+	moved := w.NewEntity()
+	moved.SetPosition(components.Position{X: 1})
+	still := w.NewEntity()
+	still.SetPosition(components.Position{X: 2})
+
+	added := 0
+	changed := 0
+	removed := 0
+	w.AddSystem(func(e ecs.Entity, _ ecs.Added[components.Position]) {
+		added++
+	})
+	w.AddSystem(func(e ecs.Entity, pos *components.Position, _ ecs.Changed[components.Position]) {
+		changed++
+	})
+	w.AddSystem(func(e ecs.Entity, pos *components.Position) {
+		w.RemovedHealth(func(e ecs.Entity) {
+			removed++
+		})
+	}, ecs.WithPhase(1))
+
+	w.Update()
+	if added != 2 || changed != 2 {
+		t.Fatal(added, changed)
+	}
+
+	moved.SetPosition(components.Position{X: 5})
+	still.SetHealth(10)
+	still.RemoveHealth()
+	added, changed, removed = 0, 0, 0
+	w.Update()
+	if added != 0 || changed != 1 || removed != 2 {
+		t.Fatal(added, changed, removed)
+	}
+
+	still.Position().X = 10
+	still.MarkPositionChanged()
+	added, changed, removed = 0, 0, 0
+	w.Update()
+	if added != 0 || changed != 1 || removed != 0 {
+		t.Fatal(added, changed, removed)
+	}
+
+	changed = 0
+	w.Select(func(e ecs.Entity, _ ecs.Changed[components.Position], pos *components.Position) {
+		changed++
+	})
+	if changed != 0 {
+		t.Fatal(changed)
+	}
+}
+
+func TestRemovalsWithoutSystems(t *testing.T) {
+	w := ecs.NewWorld()
+
+	for i := 0; i < 100; i++ {
+		e := w.NewEntity()
+		e.SetHealth(components.Health(i))
+		e.Kill()
+	}
+
+	// Without systems, removals are discarded once they have been reported
+	removed := 0
+	w.RemovedHealth(func(e ecs.Entity) {
+		removed++
+	})
+	if removed != 100 {
+		t.Fatal(removed)
+	}
+	removed = 0
+	w.RemovedHealth(func(e ecs.Entity) {
+		removed++
+	})
+	if removed != 0 {
+		t.Fatal(removed)
+	}
+
+	// Health isn't used with change detection, so it has no change tick pages
+	for _, usage := range w.MemoryStats().Components {
+		if usage.Name == "Health" && usage.Bytes != 1024*8 {
+			t.Fatal(usage.Bytes)
+		}
+	}
+}
+
+func TestHooks(t *testing.T) {
+	w := ecs.NewWorld()
+
+	bodies := map[ecs.EntityID]components.Position{}
+	sets := 0
+	w.OnPositionAdded(func(e ecs.Entity, pos *components.Position) {
+		bodies[e.ID()] = *pos
+	})
+	w.OnPositionSet(func(e ecs.Entity, pos *components.Position) {
+		sets++
+	})
+	w.OnPositionRemoved(func(e ecs.Entity, pos *components.Position) {
+		if bodies[e.ID()] != *pos {
+			t.Fatal("removed component should still be readable")
+		}
+		delete(bodies, e.ID())
+	})
+
+	e1 := w.NewEntity()
+	e2 := w.NewEntity()
+	e1.SetPosition(components.Position{X: 1})
+	e2.SetPosition(components.Position{X: 2})
+	if len(bodies) != 2 || sets != 2 {
+		t.Fatal(bodies, sets)
+	}
+
+	e1.SetPosition(components.Position{X: 1})
+	if sets != 3 {
+		t.Fatal(sets)
+	}
+
+	e1.RemovePosition()
+	e2.Kill()
+	if len(bodies) != 0 {
+		t.Fatal(bodies)
+	}
+
+	w.ClearHooks()
+	e3 := w.NewEntity()
+	e3.SetPosition(components.Position{X: 3})
+	if len(bodies) != 0 || sets != 3 {
+		t.Fatal(bodies, sets)
+	}
+}
+
+func TestReentrantHooks(t *testing.T) {
+	w := ecs.NewWorld()
+
+	removed := 0
+	w.OnHealthRemoved(func(e ecs.Entity, hp *components.Health) {
+		removed++
+		if *hp != 10 {
+			t.Fatal("removed component should still be readable")
+		}
+		e.RemoveHealth()
+		e.Kill()
+	})
+	w.OnPositionRemoved(func(e ecs.Entity, pos *components.Position) {
+		removed++
+		e.RemovePosition()
+		e.RemoveHealth()
+	})
+
+	e1 := w.NewEntity()
+	e1.SetHealth(10)
+	e1.SetPosition(components.Position{X: 1})
+	e1.RemoveHealth()
+	if removed != 2 || e1.Alive() {
+		t.Fatal(removed, e1.Alive())
+	}
+
+	// Hooks that set the component again keep it
+	w.ClearHooks()
+	w.OnHealthRemoved(func(e ecs.Entity, hp *components.Health) {
+		removed++
+		e.SetHealth(*hp + 1)
+	})
+	e2 := w.NewEntity()
+	e2.SetHealth(10)
+	e2.RemoveHealth()
+	if removed != 3 || *e2.Health() != 11 {
+		t.Fatal(removed, e2.Health())
+	}
+	e2.Kill()
+	if removed != 4 || e2.Alive() {
+		t.Fatal(removed)
+	}
+}
+
+func TestCommands(t *testing.T) {
+	w := ecs.NewWorld()
+	cmds := w.Commands()
+
+	for i := 0; i < 10; i++ {
+		w.NewEntity().SetHealth(components.Health(i))
+	}
+
+	w.AddSystem(func(e ecs.Entity, hp *components.Health) {
+		if *hp%2 == 0 {
+			cmds.Kill(e)
+			return
+		}
+		cmds.Spawn(func(child ecs.Entity) {
+			child.SetPosition(components.Position{X: int(*hp)})
+		})
+		cmds.RemoveHealth(e)
+		cmds.SetLikes(e, e)
+	})
+	w.Update()
+
+	health, pos, likes := 0, 0, 0
+	w.Select(func(e ecs.Entity, hp *components.Health) {
+		health++
+	})
+	w.Select(func(e ecs.Entity, p *components.Position) {
+		pos++
+	})
+	w.Select(func(e ecs.Entity, target ecs.Entity, l *components.Likes) {
+		likes++
+	})
+	if health != 0 || pos != 5 || likes != 5 {
+		t.Fatal(health, pos, likes)
+	}
+
+	e := w.NewEntity()
+	cmds.SetVelocity(e, components.Velocity{X: 1})
+	if e.HasVelocity() {
+		t.Fatal("command applied before flush")
+	}
+	cmds.Flush()
+	if !e.HasVelocity() {
+		t.Fatal("command not applied by flush")
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	w := ecs.NewWorld()
+
+	boy := w.NewEntity()
+	dog := w.NewEntity()
+	apple := w.NewEntity()
+	dead := w.NewEntity()
+	boy.SetPosition(components.Position{X: 4, Y: 5})
+	boy.SetHealth(45)
+	boy.SetComplex(components.Complex{Target: dog.Ref()})
+	boy.SetInventory(components.Inventory{
+		Items:  []entity.Ref{apple.Ref(), dead.Ref()},
+		Counts: map[string]int{"apple": 3},
+	})
+	boy.SetHas(apple, components.Has{Count: 3})
+	boy.SetLikes(dog)
+	boy.SetLikes(dead)
+	dog.SetPos(components.Pos{X: 1.5, Y: -2.25})
+	dead.Kill()
+
+	var buf bytes.Buffer
+	if err := w.SaveSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := ecs.NewWorld()
+	loaded.NewEntity()
+	if err := loaded.LoadSnapshot(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var newBoy ecs.Entity
+	loaded.Select(func(e ecs.Entity, pos *components.Position) {
+		newBoy = e
+	})
+	if newBoy.Is(boy) || *newBoy.Position() != (components.Position{X: 4, Y: 5}) || *newBoy.Health() != 45 {
+		t.Fatal(newBoy.Components())
+	}
+
+	newDog := loaded.Lookup(newBoy.Complex().Target)
+	if !newDog.Alive() || *newDog.Pos() != (components.Pos{X: 1.5, Y: -2.25}) {
+		t.Fatal("entity reference not remapped")
+	}
+	if !newBoy.Likes(newDog) {
+		t.Fatal("relationship not restored")
+	}
+
+	inv := newBoy.Inventory()
+	if len(inv.Items) != 2 || !inv.Items[1].Zero() || inv.Counts["apple"] != 3 {
+		t.Fatal(inv)
+	}
+	newApple := loaded.Lookup(inv.Items[0])
+	if newBoy.Has(newApple).Count != 3 {
+		t.Fatal("relationship data not restored")
+	}
+
+	if loaded.EntityCount() != 4 {
+		t.Fatal(loaded.EntityCount())
+	}
+	if err := loaded.LoadSnapshot(bytes.NewReader([]byte("garbage"))); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSnapshotCorruptLengths(t *testing.T) {
+	header := func(names ...string) []byte {
+		b := []byte("ecssnap1")
+		b = binary.AppendUvarint(b, uint64(len(names)))
+		for _, name := range names {
+			b = binary.AppendUvarint(b, uint64(len(name)))
+			b = append(b, name...)
+		}
+		return b
+	}
+	huge := uint64(math.MaxInt32)
+
+	// Snapshots that declare more data than they hold fail without allocating the declared lengths
+	corrupt := [][]byte{
+		binary.AppendUvarint([]byte("ecssnap1"), huge),
+		binary.AppendUvarint(header(), huge),
+		append(binary.AppendUvarint(binary.AppendUvarint([]byte("ecssnap1"), 1), huge), "Health"...),
+		// An Inventory with a huge item count, followed by a Counts gob of huge length
+		binary.AppendUvarint(binary.AppendUvarint(append(header("Inventory"), 1, 1, 1), huge), 0),
+		binary.AppendUvarint(binary.AppendUvarint(append(header("Inventory"), 1, 1, 1), 0), huge),
+	}
+	for i, snapshot := range corrupt {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		err := ecs.NewWorld().LoadSnapshot(bytes.NewReader(snapshot))
+		runtime.ReadMemStats(&after)
+		if err == nil {
+			t.Fatal(i, "expected error")
+		}
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Fatal(i, allocated)
+		}
+	}
+}
+
+func TestJSON(t *testing.T) {
+	level := `{"entities": [
+		{"ref": 1, "components": {"Position": {"X": 3, "Y": 4}, "Likes": [{"target": 2}], "Has": [{"target": 2, "data": {"Count": 7}}]}},
+		{"ref": 2, "components": {"Health": 20, "Complex": {"Target": 1}}}
+	]}`
+
+	w := ecs.NewWorld()
+	w.NewEntity()
+	if err := w.ImportJSON(strings.NewReader(level)); err != nil {
+		t.Fatal(err)
+	}
+
+	var boy ecs.Entity
+	w.Select(func(e ecs.Entity, pos *components.Position) {
+		boy = e
+	})
+	var apple ecs.Entity
+	w.Select(func(e ecs.Entity, hp *components.Health) {
+		apple = e
+	})
+	if !boy.Likes(apple) || boy.Has(apple).Count != 7 || !w.Lookup(apple.Complex().Target).Is(boy) {
+		t.Fatal(boy.Components(), apple.Components())
+	}
+
+	data, err := ecs.MarshalEntityJSON(boy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := w.UnmarshalEntityJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *copied.Position() != *boy.Position() || !copied.Likes(apple) || copied.Has(apple).Count != 7 {
+		t.Fatal(string(data))
+	}
+
+	var buf bytes.Buffer
+	if err := w.ExportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	exported := ecs.NewWorld()
+	if err := exported.ImportJSON(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if exported.EntityCount() != 4 {
+		t.Fatal(exported.EntityCount())
+	}
+
+	// Exporting skips dead targets without pruning them from the world
+	ghost := w.NewEntity()
+	fan := w.NewEntity()
+	fan.SetLikes(ghost)
+	ghost.Kill()
+	data, err = ecs.MarshalEntityJSON(fan)
+	if err != nil || strings.Contains(string(data), "Likes") {
+		t.Fatal(string(data), err)
+	}
+	if err := w.ExportJSON(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if len(fan.Components()) != 1 {
+		t.Fatal("export modified the world")
+	}
+	fan.Kill()
+
+	_, err = w.UnmarshalEntityJSON([]byte(`{"components": {"Nope": 1}}`))
+	if err == nil || !strings.Contains(err.Error(), "Position") {
+		t.Fatal(err)
+	}
+}
+
+func TestSelectParallel(t *testing.T) {
+	w := ecs.NewWorld()
+
+	for i := 0; i < 5000; i++ {
+		e := w.NewEntity()
+		e.SetPos(components.Pos{X: float64(i)})
+		if i%3 == 0 {
+			e.SetVel(components.Vel{X: 1})
+		}
+	}
+
+	var count atomic.Int64
+	w.SelectParallel(func(e ecs.Entity, pos *components.Pos, vel *components.Vel) {
+		pos.X += vel.X
+		count.Add(1)
+	}, 4)
+	if count.Load() != 1667 {
+		t.Fatal(count.Load())
+	}
+
+	moved := 0
+	w.Select(func(e ecs.Entity, pos *components.Pos, vel *components.Vel) {
+		if int(pos.X)%3 == 1 {
+			moved++
+		}
+	})
+	if moved != 1667 {
+		t.Fatal(moved)
+	}
+
+	// Each worker stops at the first selector call that returns false
+	count.Store(0)
+	w.SelectParallel(func(e ecs.Entity, pos *components.Pos) bool {
+		count.Add(1)
+		return false
+	}, 4)
+	if count.Load() < 1 || count.Load() > 4 {
+		t.Fatal(count.Load())
+	}
+}
+
+func TestSelectChangesVisitedEntity(t *testing.T) {
+	w := ecs.NewWorld()
+
+	for i := 0; i < 4; i++ {
+		e := w.NewEntity()
+		e.SetPos(components.Pos{})
+		if i >= 2 {
+			e.SetVel(components.Vel{})
+		}
+	}
+
+	// Entities are visited once, even if the selector changes their components
+	count := 0
+	w.Select(func(e ecs.Entity, pos *components.Pos) {
+		count++
+		if e.HasVel() {
+			e.RemoveVel()
+		} else {
+			e.SetVel(components.Vel{})
+		}
+	})
+	if count != 4 {
+		t.Fatal(count)
+	}
+}
+
+func TestSelectParallelRelationships(t *testing.T) {
+	// The race detector only catches modifications of the world when the workers run on several threads
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	w := ecs.NewWorld()
+
+	dead := w.NewEntity()
+	live := w.NewEntity()
+	for i := 0; i < 20000; i++ {
+		e := w.NewEntity()
+		e.SetPos(components.Pos{X: float64(i)})
+		if i < 15000 {
+			e.SetHas(dead, components.Has{Count: 1})
+		} else {
+			e.SetHas(live, components.Has{Count: 1})
+		}
+	}
+	// Pruning the dead target would remove the relationship from whole pages at once, which would race between
+	// workers, so parallel selects only skip it
+	dead.Kill()
+
+	var count atomic.Int64
+	w.SelectParallel(func(e ecs.Entity, target ecs.Entity, has *components.Has, pos *components.Pos) {
+		if !target.Is(live) {
+			t.Error("dead target", target)
+		}
+		count.Add(int64(has.Count))
+	}, 4)
+	if count.Load() != 5000 {
+		t.Fatal(count.Load())
+	}
+
+	count.Store(0)
+	w.Select(func(e ecs.Entity, target ecs.Entity, has *components.Has, pos *components.Pos) {
+		count.Add(int64(has.Count))
+	})
+	if count.Load() != 5000 {
+		t.Fatal(count.Load())
+	}
+}
+
+func BenchmarkSelectParallel(b *testing.B) {
+	w := ecs.NewWorld()
+
+	for i := 0; i < 100000; i++ {
+		e := w.NewEntity()
+		e.SetPos(components.Pos{X: 45, Y: 3846})
+		e.SetVel(components.Vel{X: 38456, Y: 1234})
+	}
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		w.SelectParallel(func(e ecs.Entity, pos *components.Pos, vel *components.Vel) {
+			pos.X += vel.X
+			pos.Y += vel.Y
+		}, 0)
+	}
+}
+
+func TestTypedSelect(t *testing.T) {
+	w := ecs.NewWorld()
+
+	e := w.NewEntity()
+	e.SetPos(components.Pos{X: 1})
+	e.SetVel(components.Vel{X: 2})
+	w.NewEntity().SetPos(components.Pos{X: 1})
+
+	count := 0
+	w.SelectPosVel(func(e ecs.Entity, pos *components.Pos, vel *components.Vel) {
+		pos.X += vel.X
+		count++
+	})
+	if count != 1 || e.Pos().X != 3 {
+		t.Fatal(count, e.Pos())
+	}
+
+	count = 0
+	w.SelectHasStop(func(e ecs.Entity, target ecs.Entity, has *components.Has) bool {
+		count++
+		return true
+	})
+	if count != 0 {
+		t.Fatal(count)
+	}
+}
+
+func test1(entity ecs.Entity, health *components.Health) {
+
+}
+
+func test2(entity ecs.Entity, pos *components.Position) {
+
+}
+
+func TestCompact(t *testing.T) {
+	ecs.Reset()
+
+	bank := ecs.NewEntity()
+	var bullets []ecs.Entity
+	for i := 0; i < 3000; i++ {
+		e := ecs.NewEntity()
+		e.SetHealth(components.Health(i))
+		bullets = append(bullets, e)
+	}
+	last := bullets[len(bullets)-1]
+	last.SetPortrait(components.Portrait{Pixels: [64]uint32{9}})
+	last.SetOwes(bank, components.Owes{Amount: 5})
+	last.SetWatches(bank, components.Watches{Since: 3})
+	last.SetComplex(components.Complex{Target: bank.Ref()})
+	bank.SetComplex(components.Complex{Target: last.Ref()})
+	for _, e := range bullets[:len(bullets)-1] {
+		e.Kill()
+	}
+
+	before := ecs.MemoryStats()
+	if before.Pages != 3 || before.Entities != 2 || before.Free != 2999 {
+		t.Fatal(before.Pages, before.Entities, before.Free)
+	}
+
+	moves := map[ecs.Entity]ecs.Entity{}
+	ecs.Compact(func(from ecs.Entity, to ecs.Entity) {
+		moves[from] = to
+	})
+	moved, ok := moves[last]
+	if !ok || len(moves) != 1 {
+		t.Fatal(moves)
+	}
+	if last.Alive() || !moved.Alive() || moved.ID() != 1 {
+		t.Fatal(moved.ID())
+	}
+	if *moved.Health() != 2999 || moved.Portrait().Pixels[0] != 9 || moved.Owes(bank).Amount != 5 || moved.Watches(bank).Since != 3 {
+		t.Fatal()
+	}
+	sources := 0
+	bank.EachOwesSource(func(src ecs.Entity, owes *components.Owes) {
+		if !src.Is(moved) {
+			t.Fatal(src)
+		}
+		sources++
+	})
+	if sources != 1 {
+		t.Fatal(sources)
+	}
+	if bank.Complex().Target != moved.Ref() || !ecs.Lookup(moved.Complex().Target).Is(bank) {
+		t.Fatal()
+	}
+
+	after := ecs.MemoryStats()
+	if after.Pages != 1 || after.Entities != 2 || after.Free != 0 || after.Bytes >= before.Bytes {
+		t.Fatal(after.Pages, after.Entities, after.Free, after.Bytes, before.Bytes)
+	}
+	for _, usage := range after.Components {
+		if (usage.Name == "Health" || usage.Name == "Watches") && usage.Count != 1 {
+			t.Fatal(usage.Name, usage.Count)
+		}
+	}
+
+	// Handles to released entity IDs stay dead when the IDs are reused
+	if bullets[2500].Alive() {
+		t.Fatal()
+	}
+	for i := 0; i < 3000; i++ {
+		ecs.NewEntity()
+	}
+	if bullets[2500].Alive() || last.Alive() || !moved.Alive() {
+		t.Fatal()
+	}
+	count := 0
+	ecs.Select(func(e ecs.Entity, hp *components.Health) {
+		count++
+	})
+	if count != 1 {
+		t.Fatal(count)
+	}
+}
+
+func TestSelectRareComponentPages(t *testing.T) {
+	ecs.Reset()
+
+	var entities []ecs.Entity
+	for i := 0; i < 5000; i++ {
+		e := ecs.NewEntity()
+		e.SetHealth(components.Health(i))
+		entities = append(entities, e)
+	}
+	entities[10].SetVelocity(components.Velocity{X: 1})
+	entities[3100].SetVelocity(components.Velocity{X: 2})
+	entities[4900].SetVelocity(components.Velocity{X: 3})
+
+	selected := func() []int {
+		var found []int
+		ecs.Select(func(e ecs.Entity, hp *components.Health, v *components.Velocity) {
+			found = append(found, int(*hp))
+		})
+		slices.Sort(found)
+		return found
+	}
+	if found := selected(); !slices.Equal(found, []int{10, 3100, 4900}) {
+		t.Fatal(found)
+	}
+
+	entities[10].RemoveVelocity()
+	entities[4900].Kill()
+	if found := selected(); !slices.Equal(found, []int{3100}) {
+		t.Fatal(found)
+	}
+	entities[3100].RemoveHealth()
+	if found := selected(); len(found) != 0 {
+		t.Fatal(found)
+	}
+
+	// Compacting moves the last entities into the free IDs of the first page
+	entities[3100].SetHealth(3100)
+	for _, e := range entities[:2000] {
+		e.Kill()
+	}
+	ecs.Compact(nil)
+	if found := selected(); !slices.Equal(found, []int{3100}) {
+		t.Fatal(found)
+	}
 }
@@ -1,3 +1,5 @@
+//go:build !archetype
+
 package main
 
 //go:generate go run github.com/zdandoh/ecs/codegen ecspkg ./components
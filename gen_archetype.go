@@ -0,0 +1,7 @@
+//go:build archetype
+
+package main
+
+// Building with the archetype tag generates the package with archetype storage, so that the tests can be run
+// against both storage layouts: go generate -tags archetype ./... && go test -tags archetype ./...
+//go:generate go run github.com/zdandoh/ecs/codegen -storage=archetype ecspkg ./components
@@ -0,0 +1,97 @@
+//go:build go1.23
+
+package main
+
+import (
+	"testing"
+
+	"github.com/zdandoh/ecs/components"
+	ecs "github.com/zdandoh/ecs/ecspkg"
+)
+
+func TestIter(t *testing.T) {
+	w := ecs.NewWorld()
+
+	for i := 0; i < 10; i++ {
+		e := w.NewEntity()
+		e.SetPos(components.Pos{X: float64(i)})
+		e.SetVel(components.Vel{X: 1})
+		if i%2 == 0 {
+			e.SetHealth(components.Health(i))
+		}
+	}
+
+	count := 0
+	for _, row := range w.IterPosVel() {
+		row.Pos.X += row.Vel.X
+		count++
+	}
+	if count != 10 {
+		t.Fatal(count)
+	}
+
+	count = 0
+	for e, row := range w.IterPosOptHealth() {
+		if row.Health.Ok() != e.HasHealth() {
+			t.Fatal("optional component mismatch")
+		}
+		count++
+		if count == 5 {
+			break
+		}
+	}
+	if count != 5 {
+		t.Fatal(count)
+	}
+
+	found := ecs.Entity{}
+outer:
+	for e := range w.IterVel() {
+		for range w.IterPosVel() {
+			found = e
+			break outer
+		}
+	}
+	if !found.Alive() {
+		t.Fatal("labeled break failed")
+	}
+}
+
+func TestIterRelationship(t *testing.T) {
+	w := ecs.NewWorld()
+
+	apple := w.NewEntity()
+	egg := w.NewEntity()
+	boy := w.NewEntity()
+	boy.SetPos(components.Pos{})
+	boy.SetHas(apple, components.Has{Count: 5})
+	boy.SetHas(egg, components.Has{Count: 2})
+
+	total := 0
+	for e, row := range w.IterHasPos() {
+		if !e.Is(boy) || row.Pos == nil {
+			t.Fatal(e)
+		}
+		if row.HasTarget.Is(apple) {
+			break
+		}
+		total += row.Has.Count
+	}
+	if total != 0 {
+		t.Fatal(total)
+	}
+}
+
+func TestIterRowFieldNames(t *testing.T) {
+	w := ecs.NewWorld()
+
+	e := w.NewEntity()
+	e.SetPos(components.Pos{X: 3})
+
+	// Fields of components that are selected twice are numbered
+	for _, row := range w.IterPosOptPos() {
+		if row.Pos != row.Pos2.Get() || row.Pos.X != 3 {
+			t.Fatal(row)
+		}
+	}
+}